@@ -0,0 +1,289 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrMaxObjectsLimit is returned by Header when the packfile declares
+	// more objects than the Decoder is configured to accept.
+	ErrMaxObjectsLimit = errors.New("git: packfile exceeds the configured object count limit")
+	// ErrMaxObjectSize is returned by Next when an entry's declared size
+	// exceeds the Decoder's configured limit.
+	ErrMaxObjectSize = errors.New("git: object exceeds the configured max object size")
+)
+
+const (
+	// DefaultMaxObjectsLimit is the MaxObjectsLimit a Decoder starts with.
+	DefaultMaxObjectsLimit uint32 = 1 << 20
+	// DefaultMaxObjectSize is the MaxObjectSize a Decoder starts with.
+	DefaultMaxObjectSize int64 = 1 << 32
+)
+
+// Decoder reads a packfile one object at a time, so callers never have to
+// hold the whole pack in memory. Drive it with Header followed by repeated
+// calls to Next until it returns io.EOF.
+type Decoder struct {
+	reader     *trackingReader
+	packfile   *Packfile
+	version    uint32
+	count      uint32
+	read       uint32
+	pending    []Object
+	drained    bool
+	resolveErr error
+
+	// MaxObjectsLimit caps the object count Header will accept.
+	MaxObjectsLimit uint32
+	// MaxObjectSize caps the size declared in any entry's header (its
+	// inflated size), checked before the entry is inflated.
+	MaxObjectSize int64
+	// ObjectCallback, when set, is invoked as each object is fully
+	// materialized, so callers streaming objects to disk don't need to
+	// retain them.
+	ObjectCallback func(Object) error
+	// Strict, when true, makes Next verify a delta's base object before
+	// patching against it: for OBJ_REF_DELTA, that the base still hashes
+	// to the 20 bytes the delta referenced; for OBJ_OFS_DELTA, that the
+	// base's stored hash still matches one recomputed from its bytes.
+	// Only deltas whose base was already decoded when the delta was read
+	// are checked; deltas queued and resolved once every entry has been
+	// read are patched without this check.
+	Strict bool
+	// DeltaBaseCacheLimit caps, in bytes, the LRU cache of recently
+	// patched base object bytes shared by REF_DELTA and OFS_DELTA
+	// resolution. Zero disables caching.
+	DeltaBaseCacheLimit int64
+}
+
+// NewDecoder returns a Decoder reading a packfile from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		reader: &trackingReader{reader: r, hash: sha1.New()},
+		packfile: &Packfile{
+			offsets:   make(map[int]int),
+			hashes:    make(map[string]int),
+			baseCache: newDeltaBaseCache(DefaultDeltaBaseCacheLimit),
+		},
+		MaxObjectsLimit:     DefaultMaxObjectsLimit,
+		MaxObjectSize:       DefaultMaxObjectSize,
+		DeltaBaseCacheLimit: DefaultDeltaBaseCacheLimit,
+	}
+}
+
+// Header reads the "PACK" magic, version and object count from the start
+// of the stream.
+func (d *Decoder) Header() (version, count uint32, err error) {
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(d.reader, magic); err != nil {
+		return 0, 0, err
+	}
+	if bytes.Compare(magic, []byte("PACK")) != 0 {
+		return 0, 0, errors.New("not a packfile")
+	}
+
+	binary.Read(d.reader, binary.BigEndian, &d.version)
+	binary.Read(d.reader, binary.BigEndian, &d.count)
+	if d.count > d.MaxObjectsLimit {
+		return 0, 0, ErrMaxObjectsLimit
+	}
+	d.packfile.Version = d.version
+	d.packfile.baseCache.limit = d.DeltaBaseCacheLimit
+	return d.version, d.count, nil
+}
+
+// Next decodes and returns the next object in the packfile, resolving
+// deltas against bases seen earlier in the stream where possible. Once
+// every entry has been read, it resolves any deltas that were queued
+// waiting for a base and hands those back too, finally returning io.EOF,
+// or an *ErrUnresolvedDeltas if some deltas' bases never appeared.
+func (d *Decoder) Next() (Object, error) {
+	if len(d.pending) > 0 {
+		obj := d.pending[0]
+		d.pending = d.pending[1:]
+		return obj, nil
+	}
+
+	for d.read < d.count {
+		entryOffset := d.reader.Position()
+		obj, err := d.readEntry(entryOffset)
+		d.read++
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			// Queued as an unresolved delta; keep scanning for its base.
+			continue
+		}
+		if err := d.materialize(obj, entryOffset); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	if !d.drained {
+		d.drained = true
+		contentSum := d.reader.Sum()
+		d.packfile.Checksum = make([]byte, 20)
+		io.ReadFull(d.reader, d.packfile.Checksum)
+		d.packfile.contentSum = contentSum
+		if !bytes.Equal(contentSum, d.packfile.Checksum) {
+			return nil, ErrChecksumMismatch
+		}
+
+		before := len(d.packfile.Objects)
+		resolveErr := resolveDeltas(d.packfile)
+		for _, obj := range d.packfile.Objects[before:] {
+			if d.ObjectCallback != nil {
+				if err := d.ObjectCallback(obj); err != nil {
+					return nil, err
+				}
+			}
+			d.pending = append(d.pending, obj)
+		}
+		d.resolveErr = resolveErr
+	}
+
+	if len(d.pending) > 0 {
+		obj := d.pending[0]
+		d.pending = d.pending[1:]
+		return obj, nil
+	}
+	if d.resolveErr != nil {
+		return nil, d.resolveErr
+	}
+	return nil, io.EOF
+}
+
+// materialize records a fully decoded object at its pack offset and
+// notifies ObjectCallback, if any.
+func (d *Decoder) materialize(obj Object, offset int) error {
+	d.packfile.offsets[offset] = len(d.packfile.Objects)
+	d.packfile.PutObject(obj)
+	if d.ObjectCallback != nil {
+		return d.ObjectCallback(obj)
+	}
+	return nil
+}
+
+// readEntry decodes a single packfile entry starting at offset. It
+// returns the materialized Object, or a nil Object (and nil error) when
+// the entry is a delta queued in packfile.Deltas because its base hasn't
+// been seen yet.
+func (d *Decoder) readEntry(offset int) (Object, error) {
+	reader := d.reader
+	packfile := d.packfile
+
+	var b, typ uint8
+	var sz uint64
+	binary.Read(reader, binary.BigEndian, &b)
+	typ = (b &^ 0x8f) >> 4
+	sz = uint64(b &^ 0xf0)
+	if (b & 0x80) != 0 {
+		sz += readMSBEncodedSize(reader, 4)
+	}
+	if d.MaxObjectSize > 0 && int64(sz) > d.MaxObjectSize {
+		return nil, ErrMaxObjectSize
+	}
+
+	switch typ {
+	case OBJ_REF_DELTA:
+		ref := make([]byte, 20)
+		reader.Read(ref)
+
+		buf, err := inflate(reader, int(sz))
+		if err != nil {
+			return nil, err
+		}
+
+		referenced := packfile.ObjectByHash(ref)
+		if referenced == nil {
+			packfile.Deltas = append(packfile.Deltas, Delta{Hash: ref, EntryOffset: offset, Delta: buf})
+			return nil, nil
+		}
+		if d.Strict {
+			computed, err := gitObjectHash(referenced)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(computed, ref) {
+				return nil, ErrObjectHashMismatch
+			}
+		}
+		baseBytes, cached := packfile.baseCache.Get(referenced.Hash())
+		if !cached {
+			baseBytes = referenced.Bytes()
+			packfile.baseCache.Put(referenced.Hash(), baseBytes)
+		}
+		patched := PatchDelta(baseBytes, buf)
+		if patched == nil {
+			return nil, errors.New(fmt.Sprintf("error while patching %s", hex.EncodeToString(ref)))
+		}
+		newObject := referenced.New()
+		newObject.SetBytes(patched)
+		packfile.baseCache.Put(newObject.Hash(), patched)
+		return newObject, nil
+	case OBJ_OFS_DELTA:
+		negOffset := readOffset(reader)
+		baseOffset := offset - int(negOffset)
+
+		buf, err := inflate(reader, int(sz))
+		if err != nil {
+			return nil, err
+		}
+
+		baseIndex, exists := packfile.offsets[baseOffset]
+		if !exists {
+			packfile.Deltas = append(packfile.Deltas, Delta{Offset: baseOffset, EntryOffset: offset, Delta: buf})
+			return nil, nil
+		}
+		base := packfile.Objects[baseIndex]
+		if d.Strict {
+			computed, err := gitObjectHash(base)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(computed, base.Hash()) {
+				return nil, ErrObjectHashMismatch
+			}
+		}
+		baseBytes, cached := packfile.baseCache.Get(base.Hash())
+		if !cached {
+			baseBytes = base.Bytes()
+			packfile.baseCache.Put(base.Hash(), baseBytes)
+		}
+		patched := PatchDelta(baseBytes, buf)
+		if patched == nil {
+			return nil, errors.New(fmt.Sprintf("error while patching offset delta at %d", offset))
+		}
+		newObject := base.New()
+		newObject.SetBytes(patched)
+		packfile.baseCache.Put(newObject.Hash(), patched)
+		return newObject, nil
+	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
+		buf, err := inflate(reader, int(sz))
+		if err != nil {
+			return nil, err
+		}
+		var obj Object
+		switch typ {
+		case OBJ_COMMIT:
+			obj = &Commit{Content: buf}
+		case OBJ_TREE:
+			obj = &Tree{Content: buf}
+		case OBJ_BLOB:
+			obj = &Blob{Content: buf}
+		case OBJ_TAG:
+			obj = &Tag{Content: buf}
+		}
+		return obj, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid git object tag %03b", typ))
+	}
+}
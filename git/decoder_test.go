@@ -0,0 +1,261 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// packBuilder assembles a minimal, real packfile byte-for-byte (header,
+// zlib-compressed entries, trailing checksum) so these tests exercise
+// Decoder.Header/Next exactly as a caller handed a genuine pack would,
+// rather than poking at packfile internals directly.
+type packBuilder struct {
+	buf   bytes.Buffer
+	count uint32
+}
+
+func newPackBuilder() *packBuilder {
+	pb := &packBuilder{}
+	pb.buf.WriteString("PACK")
+	binary.Write(&pb.buf, binary.BigEndian, uint32(2))
+	binary.Write(&pb.buf, binary.BigEndian, uint32(0)) // patched in bytes
+	return pb
+}
+
+// offset returns the absolute pack offset the next entry will start at.
+func (pb *packBuilder) offset() int {
+	return pb.buf.Len()
+}
+
+func deflate(content []byte) []byte {
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	zw.Write(content)
+	zw.Close()
+	return out.Bytes()
+}
+
+func (pb *packBuilder) addObject(typ uint8, content []byte) int {
+	off := pb.offset()
+	writeTypeSize(&pb.buf, typ, uint64(len(content)))
+	pb.buf.Write(deflate(content))
+	pb.count++
+	return off
+}
+
+func (pb *packBuilder) addRefDelta(base []byte, delta []byte) int {
+	off := pb.offset()
+	writeTypeSize(&pb.buf, OBJ_REF_DELTA, uint64(len(delta)))
+	pb.buf.Write(base)
+	pb.buf.Write(deflate(delta))
+	pb.count++
+	return off
+}
+
+func (pb *packBuilder) addOfsDelta(baseOffset int, delta []byte) int {
+	off := pb.offset()
+	writeTypeSize(&pb.buf, OBJ_OFS_DELTA, uint64(len(delta)))
+	pb.buf.Write(encodeOfsOffset(uint64(off - baseOffset)))
+	pb.buf.Write(deflate(delta))
+	pb.count++
+	return off
+}
+
+// bytes finalizes the object count in the header and appends the trailing
+// checksum, matching what trackingReader computes over the header and
+// entries while decoding.
+func (pb *packBuilder) bytes() []byte {
+	raw := pb.buf.Bytes()
+	binary.BigEndian.PutUint32(raw[8:12], pb.count)
+	sum := sha1.Sum(raw)
+	return append(raw, sum[:]...)
+}
+
+// encodeOfsOffset is the inverse of readOffset (pack.go), verified against
+// the same cases readOffset's own test checks.
+func encodeOfsOffset(offset uint64) []byte {
+	stack := []byte{byte(offset & 0x7f)}
+	offset >>= 7
+	for offset > 0 {
+		offset--
+		stack = append(stack, byte(offset&0x7f)|0x80)
+		offset >>= 7
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// encodeInsertOnlyDelta builds a valid git delta (pack-format.txt's
+// "insert data" instructions only, no copy instructions) that reconstructs
+// target verbatim from base via PatchDelta. It doesn't need to know
+// anything about base's content, which keeps these tests independent of
+// PatchDelta's copy-instruction encoding.
+func encodeInsertOnlyDelta(base, target []byte) []byte {
+	var buf bytes.Buffer
+	encodeDeltaVarint(&buf, uint64(len(base)))
+	encodeDeltaVarint(&buf, uint64(len(target)))
+	for len(target) > 0 {
+		n := len(target)
+		if n > 127 {
+			n = 127
+		}
+		buf.WriteByte(byte(n))
+		buf.Write(target[:n])
+		target = target[n:]
+	}
+	return buf.Bytes()
+}
+
+func encodeDeltaVarint(buf *bytes.Buffer, v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			buf.WriteByte(b)
+			return
+		}
+		buf.WriteByte(b | 0x80)
+	}
+}
+
+func decodeAll(t *testing.T, pack []byte) ([]Object, error) {
+	t.Helper()
+	dec := NewDecoder(bytes.NewReader(pack))
+	if _, _, err := dec.Header(); err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+	var objs []Object
+	for {
+		obj, err := dec.Next()
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return objs, err
+		}
+		objs = append(objs, obj)
+	}
+}
+
+func TestDecoderResolvesOfsDeltaChain(t *testing.T) {
+	base := &Blob{Content: []byte("the base blob content, used as a delta source")}
+	target := []byte("the base blob content, used as a DELTA-PATCHED result")
+
+	pb := newPackBuilder()
+	baseOffset := pb.addObject(OBJ_BLOB, base.Content)
+	pb.addOfsDelta(baseOffset, encodeInsertOnlyDelta(base.Content, target))
+
+	objs, err := decodeAll(t, pb.bytes())
+	if err != nil {
+		t.Fatalf("decodeAll: %v", err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("got %d objects; want 2", len(objs))
+	}
+	if !bytes.Equal(objs[1].Bytes(), target) {
+		t.Fatalf("patched object = %q; want %q", objs[1].Bytes(), target)
+	}
+}
+
+// TestDecoderResolvesForwardRefDelta queues a REF_DELTA whose base appears
+// later in the pack, exercising resolveDeltas' fixed-point drain at EOF
+// rather than the inline resolve-on-read path.
+func TestDecoderResolvesForwardRefDelta(t *testing.T) {
+	base := &Blob{Content: []byte("a forward-referenced base blob")}
+	target := []byte("a forward-referenced, now-patched blob")
+
+	pb := newPackBuilder()
+	pb.addRefDelta(base.Hash(), encodeInsertOnlyDelta(base.Content, target))
+	pb.addObject(OBJ_BLOB, base.Content)
+
+	objs, err := decodeAll(t, pb.bytes())
+	if err != nil {
+		t.Fatalf("decodeAll: %v", err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("got %d objects; want 2", len(objs))
+	}
+	var gotTarget bool
+	for _, o := range objs {
+		if bytes.Equal(o.Bytes(), target) {
+			gotTarget = true
+		}
+	}
+	if !gotTarget {
+		t.Fatalf("no decoded object matched the patched target %q", target)
+	}
+}
+
+func TestDecoderUnresolvedDelta(t *testing.T) {
+	pb := newPackBuilder()
+	pb.addOfsDelta(0, encodeInsertOnlyDelta([]byte("missing base"), []byte("target")))
+
+	_, err := decodeAll(t, pb.bytes())
+	if _, ok := err.(*ErrUnresolvedDeltas); !ok {
+		t.Fatalf("err = %v (%T); want *ErrUnresolvedDeltas", err, err)
+	}
+}
+
+func TestDecoderChecksumMismatch(t *testing.T) {
+	pb := newPackBuilder()
+	pb.addObject(OBJ_BLOB, []byte("some blob content"))
+
+	pack := pb.bytes()
+	pack[len(pack)-1] ^= 0xff // corrupt the trailing checksum
+
+	if _, err := decodeAll(t, pack); err != ErrChecksumMismatch {
+		t.Fatalf("err = %v; want ErrChecksumMismatch", err)
+	}
+}
+
+func TestDecoderStrictAllowsValidDeltaChain(t *testing.T) {
+	base := &Blob{Content: []byte("a strict-mode base blob")}
+	target := []byte("a strict-mode, delta-patched blob")
+
+	pb := newPackBuilder()
+	pb.addRefDelta(base.Hash(), encodeInsertOnlyDelta(base.Content, target))
+	pb.addObject(OBJ_BLOB, base.Content)
+
+	dec := NewDecoder(bytes.NewReader(pb.bytes()))
+	dec.Strict = true
+	if _, _, err := dec.Header(); err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+	for {
+		_, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next (Strict): %v", err)
+		}
+	}
+}
+
+func TestDeltaBaseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newDeltaBaseCache(10)
+	c.Put([]byte("a"), []byte("12345")) // size 5
+	c.Put([]byte("b"), []byte("12345")) // size 10, at limit
+
+	if _, ok := c.Get([]byte("a")); !ok {
+		t.Fatalf("entry a evicted too early")
+	}
+	// a is now most-recently-used; b is the eviction candidate.
+	c.Put([]byte("c"), []byte("12345")) // pushes size to 15 > limit 10, evicts b
+
+	if _, ok := c.Get([]byte("b")); ok {
+		t.Fatalf("entry b should have been evicted as least-recently-used")
+	}
+	if _, ok := c.Get([]byte("a")); !ok {
+		t.Fatalf("entry a should still be cached")
+	}
+	if _, ok := c.Get([]byte("c")); !ok {
+		t.Fatalf("entry c should be cached")
+	}
+}
@@ -0,0 +1,88 @@
+package git
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// ErrUnresolvedDeltas is returned by resolveDeltas when one or more
+// deltas never found their base object anywhere in the pack, even after
+// resolving to a fixed point.
+type ErrUnresolvedDeltas struct {
+	// Hashes lists the missing bases: hex-encoded SHA-1s for REF_DELTA
+	// entries, or "offset:<n>" for OFS_DELTA entries, which have no hash
+	// to report.
+	Hashes []string
+}
+
+func (e *ErrUnresolvedDeltas) Error() string {
+	return fmt.Sprintf("git: %d delta(s) reference a base not present in this pack: %s",
+		len(e.Hashes), strings.Join(e.Hashes, ", "))
+}
+
+// DefaultDeltaBaseCacheLimit is the deltaBaseCache size a Packfile starts
+// with, mirroring Git's own core.deltaBaseCacheLimit default.
+const DefaultDeltaBaseCacheLimit int64 = 96 << 20
+
+// deltaBaseCache is a byte-budgeted LRU cache of recently patched base
+// object bytes, keyed by hash. It's shared between the REF_DELTA and
+// OFS_DELTA resolution paths so a base sitting at the root of a long
+// chain of dependents isn't re-fetched once per dependent.
+type deltaBaseCache struct {
+	limit int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type deltaBaseCacheEntry struct {
+	key   string
+	value []byte
+}
+
+func newDeltaBaseCache(limit int64) *deltaBaseCache {
+	return &deltaBaseCache{
+		limit: limit,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *deltaBaseCache) Get(hash []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	elem, ok := c.items[string(hash)]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*deltaBaseCacheEntry).value, true
+}
+
+func (c *deltaBaseCache) Put(hash []byte, value []byte) {
+	if c == nil || c.limit <= 0 {
+		return
+	}
+	key := string(hash)
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*deltaBaseCacheEntry).value = value
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&deltaBaseCacheEntry{key: key, value: value})
+	c.size += int64(len(value))
+
+	for c.size > c.limit {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		entry := oldest.Value.(*deltaBaseCacheEntry)
+		delete(c.items, entry.key)
+		c.size -= int64(len(entry.value))
+	}
+}
@@ -1,20 +1,28 @@
 package git
 
 import (
-	"bytes"
-	"compress/flate"
 	"compress/zlib"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
 )
 
 type Delta struct {
-	Hash  []byte
-	Delta []byte
+	Hash []byte
+	// Offset is the absolute offset, within the packfile, of the base
+	// object for an OBJ_OFS_DELTA entry whose base hasn't been
+	// materialized yet. It is zero (and Hash is set instead) for
+	// OBJ_REF_DELTA entries.
+	Offset int
+	// EntryOffset is the absolute offset, within the packfile, of this
+	// delta entry itself (as opposed to Offset, its base's). It's what
+	// packfile.offsets must be keyed on once the delta resolves, so that
+	// a later OFS_DELTA pointing at this entry can find it.
+	EntryOffset int
+	Delta       []byte
 }
 
 type Packfile struct {
@@ -24,6 +32,12 @@ type Packfile struct {
 	Deltas   []Delta
 	offsets  map[int]int
 	hashes   map[string]int
+	// contentSum is the SHA-1 computed over the header and every entry as
+	// they were decoded, for later comparison against Checksum by Verify.
+	contentSum []byte
+	// baseCache memoizes recently patched base object bytes across
+	// REF_DELTA and OFS_DELTA resolution. Nil disables caching.
+	baseCache *deltaBaseCache
 }
 
 func (r *Packfile) ObjectByHash(hash []byte) Object {
@@ -62,156 +76,153 @@ func inflate(reader io.Reader, sz int) ([]byte, error) {
 	}
 	buf := make([]byte, sz)
 
-	n, err := zr.Read(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	if n != sz {
-		return nil, errors.New(fmt.Sprintf("inflated size mismatch, expected %d, got %d", sz, n))
+	// A single Read isn't guaranteed to fill buf: flate hands back data in
+	// internal window-sized chunks, and its final Read legitimately pairs
+	// a full read with io.EOF. io.ReadFull loops until buf is full, only
+	// erroring if fewer than sz bytes were actually available.
+	if _, err := io.ReadFull(zr, buf); err != nil {
+		return nil, errors.New(fmt.Sprintf("inflated size mismatch, expected %d: %v", sz, err))
 	}
 
 	zr.Close()
 	return buf, nil
 }
 
-func readEntry(packfile *Packfile, reader flate.Reader) error {
-	var b, typ uint8
-	var sz uint64
+// readOffset decodes the variable-length negative offset used by
+// OBJ_OFS_DELTA entries: the first byte's low 7 bits seed the value, and
+// while the byte just read has its high bit set, another byte is read and
+// the running value becomes ((value + 1) << 7) | (that byte's low 7 bits).
+func readOffset(reader io.Reader) uint64 {
+	var b byte
 	binary.Read(reader, binary.BigEndian, &b)
-	typ = (b &^ 0x8f) >> 4
-	sz = uint64(b &^ 0xf0)
-	switch typ {
-	case OBJ_REF_DELTA:
-		if (b & 0x80) != 0 {
-			sz += readMSBEncodedSize(reader, 4)
-		}
-		ref := make([]byte, 20)
-		reader.Read(ref)
+	offset := uint64(b & 0x7f)
+	for (b & 0x80) != 0 {
+		binary.Read(reader, binary.BigEndian, &b)
+		offset = ((offset + 1) << 7) | uint64(b&0x7f)
+	}
+	return offset
+}
 
-		buf, err := inflate(reader, int(sz))
-		if err != nil {
-			return err
-		}
+// resolveDeltas resolves packfile.Deltas against bases already present in
+// packfile.Objects, iterating to a fixed point: a base may itself have
+// arrived as an unresolved delta (REF pointing at a REF, or an OFS delta
+// whose base appears later in the pack), so keep making passes until a
+// full pass resolves nothing more. It returns an *ErrUnresolvedDeltas if
+// any deltas are still left once no further progress can be made.
+func resolveDeltas(packfile *Packfile) error {
+	cache := packfile.baseCache
+	for {
+		var unresolvedDeltas []Delta
+		progress := false
+		for i := range packfile.Deltas {
+			delta := packfile.Deltas[i]
+			var base Object
+			if delta.Hash != nil {
+				base = packfile.ObjectByHash(delta.Hash)
+			} else if index, exists := packfile.offsets[delta.Offset]; exists {
+				base = packfile.Objects[index]
+			}
+			if base == nil {
+				unresolvedDeltas = append(unresolvedDeltas, delta)
+				continue
+			}
 
-		referenced := packfile.ObjectByHash(ref)
-		if referenced == nil {
-			packfile.Deltas = append(packfile.Deltas, Delta{Hash: ref, Delta: buf})
-		} else {
-			patched := PatchDelta(referenced.Bytes(), buf)
-			if patched == nil {
-				return errors.New(fmt.Sprintf("error while patching %s", hex.EncodeToString(ref)))
+			baseBytes, cached := cache.Get(base.Hash())
+			if !cached {
+				baseBytes = base.Bytes()
+				cache.Put(base.Hash(), baseBytes)
 			}
-			newObject := referenced.New()
+			patched := PatchDelta(baseBytes, delta.Delta)
+			newObject := base.New()
 			newObject.SetBytes(patched)
+			cache.Put(newObject.Hash(), patched)
+			packfile.offsets[delta.EntryOffset] = len(packfile.Objects)
 			packfile.PutObject(newObject)
+			progress = true
 		}
-	case OBJ_OFS_DELTA:
-		if (b & 0x80) != 0 {
-			sz += readMSBEncodedSize(reader, 4)
-		}
-		// TODO: read the negative offset
-		_, err := inflate(reader, int(sz))
-		if err != nil {
-			return err
-		}
-		// packfile.Objects = append(packfile.Objects, buf)
-	case OBJ_COMMIT, OBJ_TREE, OBJ_BLOB, OBJ_TAG:
-		if (b & 0x80) != 0 {
-			sz += readMSBEncodedSize(reader, 4)
-		}
-		buf, err := inflate(reader, int(sz))
-		if err != nil {
-			return err
+		packfile.Deltas = unresolvedDeltas
+		if !progress || len(unresolvedDeltas) == 0 {
+			break
 		}
-		var obj Object
-		switch typ {
-		case OBJ_COMMIT:
-			obj = &Commit{Content: buf}
-		case OBJ_TREE:
-			obj = &Tree{Content: buf}
-		case OBJ_BLOB:
-			obj = &Blob{Content: buf}
-		case OBJ_TAG:
-			obj = &Tag{Content: buf}
+	}
+	if len(packfile.Deltas) > 0 {
+		hashes := make([]string, len(packfile.Deltas))
+		for i, delta := range packfile.Deltas {
+			if delta.Hash != nil {
+				hashes[i] = hex.EncodeToString(delta.Hash)
+			} else {
+				hashes[i] = fmt.Sprintf("offset:%d", delta.Offset)
+			}
 		}
-		packfile.PutObject(obj)
-	default:
-		return errors.New(fmt.Sprintf("Invalid git object tag %03b", typ))
+		return &ErrUnresolvedDeltas{Hashes: hashes}
 	}
 	return nil
 }
 
+// ReadPackfile reads an entire packfile from r and returns it fully
+// decoded. It is a convenience wrapper around Decoder for callers that
+// don't need to stream objects one at a time.
 func ReadPackfile(r io.Reader) (*Packfile, error) {
-	// bufreader := bufio.NewReader(r)
-
-	magic := make([]byte, 4)
-	r.Read(magic)
-	if bytes.Compare(magic, []byte("PACK")) != 0 {
-		return nil, errors.New("not a packfile")
-	}
-	packfile := &Packfile{offsets: make(map[int]int), hashes: make(map[string]int)}
-
-	var objects uint32
-	binary.Read(r, binary.BigEndian, &packfile.Version)
-	binary.Read(r, binary.BigEndian, &objects)
-
-	content, err := ioutil.ReadAll(r)
-	if err != nil {
+	dec := NewDecoder(r)
+	if _, _, err := dec.Header(); err != nil {
 		return nil, err
 	}
-	offset := 12
-
-	for i := 0; i < int(objects); i++ {
-		peReader := &packEntryReader{reader: bytes.NewBuffer(content)}
-		err := readEntry(packfile, peReader)
-		if err != nil {
-			return packfile, err
+	for {
+		_, err := dec.Next()
+		if err == io.EOF {
+			break
 		}
-		packfile.offsets[offset] = len(packfile.Objects) - 1
-
-		offset += peReader.Counter + 4
-		content = content[peReader.Counter+4:]
-
-	}
-	packfile.Checksum = make([]byte, 20)
-	bytes.NewBuffer(content).Read(packfile.Checksum)
-
-	var unresolvedDeltas []Delta
-	for i := range packfile.Deltas {
-		ref := packfile.ObjectByHash(packfile.Deltas[i].Hash)
-		if ref == nil {
-			unresolvedDeltas = append(unresolvedDeltas, packfile.Deltas[i])
-		} else {
-			patched := PatchDelta(ref.Bytes(), packfile.Deltas[i].Delta)
-			newObject := ref.New()
-			newObject.SetBytes(patched)
-			packfile.Objects = append(packfile.Objects, newObject)
+		if err != nil {
+			return dec.packfile, err
 		}
 	}
-	packfile.Deltas = unresolvedDeltas
-	return packfile, nil
+	return dec.packfile, nil
 }
 
-// This byte-counting hack is here to work around the fact that both zlib
-// and flate use bufio and are very eager to read more data than they need.
-// The counter in this reader allows us to know the length of the header +
-// packed data read and therefore readjust the offset
-type packEntryReader struct {
-	Counter int
-	reader  io.Reader
+// trackingReader wraps an io.Reader and keeps an accurate count of the
+// bytes actually consumed from it, crediting only the n a Read call
+// really returned rather than the size of the caller's buffer. It also
+// implements io.ByteReader itself so zlib/flate don't wrap it in their
+// own bufio.Reader, which would read ahead far past an entry's boundary
+// and make Position() useless for finding the next object's offset.
+//
+// Every byte it hands back is also fed into hash, if set, so callers can
+// get a running digest of everything read without a second pass.
+type trackingReader struct {
+	reader io.Reader
+	pos    int
+	hash   hash.Hash
 }
 
-func (r *packEntryReader) Read(p []byte) (int, error) {
-	r.Counter += (len(p))
-	return r.reader.Read(p)
+func (r *trackingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pos += n
+	if n > 0 && r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	return n, err
 }
 
-func (r *packEntryReader) ReadByte() (byte, error) {
-	b := make([]byte, 1)
-	_, err := r.Read(b)
+func (r *trackingReader) ReadByte() (byte, error) {
+	var b [1]byte
+	n, err := r.reader.Read(b[:])
+	r.pos += n
+	if n > 0 && r.hash != nil {
+		r.hash.Write(b[:n])
+	}
 	if err != nil {
 		return 0, err
 	}
 	return b[0], nil
 }
+
+// Position returns the number of bytes read so far from the underlying
+// reader.
+func (r *trackingReader) Position() int {
+	return r.pos
+}
+
+// Sum returns the current digest of every byte read so far.
+func (r *trackingReader) Sum() []byte {
+	return r.hash.Sum(nil)
+}
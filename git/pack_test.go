@@ -0,0 +1,103 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+func TestTrackingReaderPosition(t *testing.T) {
+	data := []byte("hello, packfile")
+	tr := &trackingReader{reader: bytes.NewReader(data)}
+
+	buf := make([]byte, 5)
+	n, err := tr.Read(buf)
+	if err != nil || n != 5 {
+		t.Fatalf("Read() = %d, %v; want 5, nil", n, err)
+	}
+	if tr.Position() != 5 {
+		t.Fatalf("Position() = %d; want 5", tr.Position())
+	}
+
+	b, err := tr.ReadByte()
+	if err != nil || b != data[5] {
+		t.Fatalf("ReadByte() = %q, %v; want %q, nil", b, err, data[5])
+	}
+	if tr.Position() != 6 {
+		t.Fatalf("Position() = %d; want 6", tr.Position())
+	}
+}
+
+// TestTrackingReaderPositionShortRead guards the fix this type exists for:
+// Position must only advance by bytes actually read, not by len(p).
+func TestTrackingReaderPositionShortRead(t *testing.T) {
+	data := []byte("ab")
+	tr := &trackingReader{reader: bytes.NewReader(data)}
+
+	buf := make([]byte, 10)
+	n, _ := tr.Read(buf)
+	if n != len(data) {
+		t.Fatalf("Read() = %d; want %d", n, len(data))
+	}
+	if tr.Position() != len(data) {
+		t.Fatalf("Position() = %d; want %d (len(p) was %d)", tr.Position(), len(data), len(buf))
+	}
+}
+
+func TestTrackingReaderSum(t *testing.T) {
+	data := []byte("the quick brown fox")
+	want := sha1.Sum(data)
+
+	tr := &trackingReader{reader: bytes.NewReader(data), hash: sha1.New()}
+	buf := make([]byte, len(data))
+	if _, err := tr.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got := tr.Sum(); !bytes.Equal(got, want[:]) {
+		t.Fatalf("Sum() = %x; want %x", got, want)
+	}
+}
+
+// decodeTypeSize mirrors readEntry's header parse, so it can check
+// writeTypeSize against the decoder it's meant to feed.
+func decodeTypeSize(r *bytes.Buffer) (uint8, uint64) {
+	var b uint8
+	binary.Read(r, binary.BigEndian, &b)
+	typ := (b &^ 0x8f) >> 4
+	sz := uint64(b &^ 0xf0)
+	if (b & 0x80) != 0 {
+		sz += readMSBEncodedSize(r, 4)
+	}
+	return typ, sz
+}
+
+func TestWriteTypeSizeRoundTrip(t *testing.T) {
+	sizes := []uint64{0, 1, 15, 16, 127, 128, 1 << 20, 1<<34 + 7}
+	for _, sz := range sizes {
+		var buf bytes.Buffer
+		writeTypeSize(&buf, OBJ_BLOB, sz)
+
+		gotTyp, gotSz := decodeTypeSize(&buf)
+		if gotTyp != OBJ_BLOB || gotSz != sz {
+			t.Errorf("writeTypeSize(%d) round-tripped to (%d, %d); want (%d, %d)",
+				sz, gotTyp, gotSz, OBJ_BLOB, sz)
+		}
+	}
+}
+
+func TestReadOffset(t *testing.T) {
+	cases := []struct {
+		bytes []byte
+		want  uint64
+	}{
+		{[]byte{0x05}, 5},
+		{[]byte{0x81, 0x02}, 258},
+	}
+	for _, c := range cases {
+		got := readOffset(bytes.NewReader(c.bytes))
+		if got != c.want {
+			t.Errorf("readOffset(%#v) = %d; want %d", c.bytes, got, c.want)
+		}
+	}
+}
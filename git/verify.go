@@ -0,0 +1,62 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrChecksumMismatch is returned when the trailing 20-byte SHA-1 of a
+	// packfile doesn't match the hash of the header and entries decoded
+	// from it.
+	ErrChecksumMismatch = errors.New("git: packfile checksum mismatch")
+	// ErrObjectHashMismatch is returned, in Decoder.Strict mode, when an
+	// object's hash doesn't match what a delta base reference to it
+	// implied, and by Verify when an object's hash doesn't match what
+	// its own raw bytes hash to.
+	ErrObjectHashMismatch = errors.New("git: object hash mismatch")
+)
+
+var objectTypeName = map[uint8]string{
+	OBJ_COMMIT: "commit",
+	OBJ_TREE:   "tree",
+	OBJ_BLOB:   "blob",
+	OBJ_TAG:    "tag",
+}
+
+// gitObjectHash recomputes sha1("<type> <size>\x00<content>") for o
+// directly from o.Bytes(), independent of (and so usable to check)
+// o.Hash() and any map keyed by it.
+func gitObjectHash(o Object) ([]byte, error) {
+	typ, err := objectType(o)
+	if err != nil {
+		return nil, err
+	}
+	content := o.Bytes()
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", objectTypeName[typ], len(content))
+	h.Write(content)
+	return h.Sum(nil), nil
+}
+
+// Verify re-checks a decoded packfile: that its trailing checksum matches
+// the SHA-1 computed while decoding it, and that every object's hash,
+// recomputed from its raw bytes, still matches the hash it's indexed
+// under.
+func (p *Packfile) Verify() error {
+	if p.contentSum != nil && p.Checksum != nil && !bytes.Equal(p.contentSum, p.Checksum) {
+		return ErrChecksumMismatch
+	}
+	for hash, index := range p.hashes {
+		computed, err := gitObjectHash(p.Objects[index])
+		if err != nil {
+			return err
+		}
+		if string(computed) != hash {
+			return ErrObjectHashMismatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// packEntry tracks everything WriteIndex needs about an object already
+// written into a PackfileWriter's pack.
+type packEntry struct {
+	hash   []byte
+	offset int
+	crc    uint32
+}
+
+// PackfileWriter writes objects as a v2 packfile plus, on request, its
+// accompanying v2 pack index. The object count in the pack header can
+// only be known once every object has been written, so entries are
+// encoded (type/size header + zlib-compressed content) as WriteObject is
+// called but only flushed to w by Close.
+type PackfileWriter struct {
+	w        io.Writer
+	buf      *bytes.Buffer
+	entries  []packEntry
+	checksum []byte
+}
+
+// NewPackfileWriter returns a PackfileWriter that will emit a packfile to w.
+func NewPackfileWriter(w io.Writer) *PackfileWriter {
+	return &PackfileWriter{w: w, buf: new(bytes.Buffer)}
+}
+
+// objectType maps a concrete Object to its OBJ_* wire type.
+func objectType(o Object) (uint8, error) {
+	switch o.(type) {
+	case *Commit:
+		return OBJ_COMMIT, nil
+	case *Tree:
+		return OBJ_TREE, nil
+	case *Blob:
+		return OBJ_BLOB, nil
+	case *Tag:
+		return OBJ_TAG, nil
+	default:
+		return 0, errors.New(fmt.Sprintf("git: cannot write object of type %T", o))
+	}
+}
+
+// writeTypeSize encodes the variable-length type/size header that
+// precedes an entry's zlib-compressed content: the first byte holds the
+// 3-bit type and the low 4 bits of the size, and every following byte
+// (while the continuation bit is set) contributes 7 more bits.
+func writeTypeSize(buf *bytes.Buffer, typ uint8, sz uint64) {
+	b := (typ << 4) | uint8(sz&0x0f)
+	sz >>= 4
+	for sz != 0 {
+		buf.WriteByte(b | 0x80)
+		b = uint8(sz & 0x7f)
+		sz >>= 7
+	}
+	buf.WriteByte(b)
+}
+
+// WriteObject encodes o and buffers it for the next Close call. The
+// packfile header is exactly 12 bytes ("PACK" + version + count), so the
+// entry's final offset can be computed as soon as it's buffered.
+func (pw *PackfileWriter) WriteObject(o Object) error {
+	typ, err := objectType(o)
+	if err != nil {
+		return err
+	}
+	content := o.Bytes()
+
+	var entry bytes.Buffer
+	writeTypeSize(&entry, typ, uint64(len(content)))
+	zw := zlib.NewWriter(&entry)
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	data := entry.Bytes()
+	pw.entries = append(pw.entries, packEntry{
+		hash:   o.Hash(),
+		offset: 12 + pw.buf.Len(),
+		crc:    crc32.ChecksumIEEE(data),
+	})
+	pw.buf.Write(data)
+	return nil
+}
+
+// Close writes the packfile header (with the now-known object count),
+// every buffered entry, and the trailing SHA-1 of both.
+func (pw *PackfileWriter) Close() error {
+	h := sha1.New()
+	mw := io.MultiWriter(pw.w, h)
+
+	if _, err := mw.Write([]byte("PACK")); err != nil {
+		return err
+	}
+	if err := binary.Write(mw, binary.BigEndian, uint32(2)); err != nil {
+		return err
+	}
+	if err := binary.Write(mw, binary.BigEndian, uint32(len(pw.entries))); err != nil {
+		return err
+	}
+	if _, err := mw.Write(pw.buf.Bytes()); err != nil {
+		return err
+	}
+
+	pw.checksum = h.Sum(nil)
+	_, err := pw.w.Write(pw.checksum)
+	return err
+}
+
+// WriteIndex writes a Git pack-index v2 file describing the objects
+// written so far: a 256-entry fanout table, the sorted SHA-1 and CRC32
+// tables, a 4-byte offset table (with an 8-byte overflow table for
+// offsets that don't fit in 31 bits), and finally the pack's checksum
+// and the index's own. Close must be called first, since the pack's
+// checksum is part of the index trailer.
+func (pw *PackfileWriter) WriteIndex(w io.Writer) error {
+	if pw.checksum == nil {
+		return errors.New("git: WriteIndex called before Close")
+	}
+
+	entries := make([]packEntry, len(pw.entries))
+	copy(entries, pw.entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash, entries[j].hash) < 0
+	})
+
+	h := sha1.New()
+	mw := io.MultiWriter(w, h)
+
+	if _, err := mw.Write([]byte{0xff, 't', 'O', 'c'}); err != nil {
+		return err
+	}
+	if err := binary.Write(mw, binary.BigEndian, uint32(2)); err != nil {
+		return err
+	}
+
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	for _, count := range fanout {
+		if err := binary.Write(mw, binary.BigEndian, count); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if _, err := mw.Write(e.hash); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if err := binary.Write(mw, binary.BigEndian, e.crc); err != nil {
+			return err
+		}
+	}
+
+	var overflow []uint64
+	for _, e := range entries {
+		offset := uint32(e.offset)
+		if e.offset >= (1 << 31) {
+			offset = 0x80000000 | uint32(len(overflow))
+			overflow = append(overflow, uint64(e.offset))
+		}
+		if err := binary.Write(mw, binary.BigEndian, offset); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range overflow {
+		if err := binary.Write(mw, binary.BigEndian, o); err != nil {
+			return err
+		}
+	}
+
+	if _, err := mw.Write(pw.checksum); err != nil {
+		return err
+	}
+
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
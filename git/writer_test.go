@@ -0,0 +1,108 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+func hashWithFirstBytes(bs ...byte) []byte {
+	h := make([]byte, 20)
+	copy(h, bs)
+	return h
+}
+
+// TestWriteIndexFanoutAndOffsets builds a PackfileWriter's entries by hand
+// (bypassing WriteObject, which needs a concrete Object) to exercise
+// WriteIndex's fanout table, sorted hash/CRC tables, and the 4-byte/8-byte
+// offset+overflow split for an offset that doesn't fit in 31 bits.
+func TestWriteIndexFanoutAndOffsets(t *testing.T) {
+	const bigOffset = 1<<31 + 5
+
+	pw := NewPackfileWriter(new(bytes.Buffer))
+	pw.checksum = bytes.Repeat([]byte{0xab}, 20)
+	pw.entries = []packEntry{
+		{hash: hashWithFirstBytes(0x02, 0x01), offset: 200, crc: 0x2222},
+		{hash: hashWithFirstBytes(0x01), offset: 100, crc: 0x1111},
+		{hash: hashWithFirstBytes(0x02, 0x00), offset: bigOffset, crc: 0x3333},
+	}
+
+	var idx bytes.Buffer
+	if err := pw.WriteIndex(&idx); err != nil {
+		t.Fatalf("WriteIndex: %v", err)
+	}
+
+	buf := idx.Bytes()
+	if !bytes.Equal(buf[0:4], []byte{0xff, 't', 'O', 'c'}) {
+		t.Fatalf("magic = %x; want ff744f63", buf[0:4])
+	}
+	pos := 4
+	if v := binary.BigEndian.Uint32(buf[pos:]); v != 2 {
+		t.Fatalf("version = %d; want 2", v)
+	}
+	pos += 4
+
+	fanout := make([]uint32, 256)
+	for i := range fanout {
+		fanout[i] = binary.BigEndian.Uint32(buf[pos:])
+		pos += 4
+	}
+	// Sorted order is: 0x01.. (1 entry), then 0x02,0x00.. and 0x02,0x01.. (2 entries).
+	if fanout[0x00] != 0 {
+		t.Errorf("fanout[0x00] = %d; want 0", fanout[0x00])
+	}
+	if fanout[0x01] != 1 {
+		t.Errorf("fanout[0x01] = %d; want 1", fanout[0x01])
+	}
+	if fanout[0x02] != 3 {
+		t.Errorf("fanout[0x02] = %d; want 3", fanout[0x02])
+	}
+	if fanout[0xff] != 3 {
+		t.Errorf("fanout[0xff] = %d; want 3", fanout[0xff])
+	}
+
+	wantOrder := [][]byte{
+		hashWithFirstBytes(0x01),
+		hashWithFirstBytes(0x02, 0x00),
+		hashWithFirstBytes(0x02, 0x01),
+	}
+	for _, want := range wantOrder {
+		if !bytes.Equal(buf[pos:pos+20], want) {
+			t.Fatalf("hash table at %d = %x; want %x", pos, buf[pos:pos+20], want)
+		}
+		pos += 20
+	}
+
+	wantCRCs := []uint32{0x1111, 0x3333, 0x2222}
+	for _, want := range wantCRCs {
+		if got := binary.BigEndian.Uint32(buf[pos:]); got != want {
+			t.Errorf("crc at %d = %x; want %x", pos, got, want)
+		}
+		pos += 4
+	}
+
+	wantOffsets := []uint32{100, 0x80000000, 200}
+	for i, want := range wantOffsets {
+		if got := binary.BigEndian.Uint32(buf[pos:]); got != want {
+			t.Errorf("offset[%d] at %d = %x; want %x", i, pos, got, want)
+		}
+		pos += 4
+	}
+
+	overflow := binary.BigEndian.Uint64(buf[pos:])
+	if overflow != bigOffset {
+		t.Errorf("overflow offset = %d; want %d", overflow, bigOffset)
+	}
+	pos += 8
+
+	if !bytes.Equal(buf[pos:pos+20], pw.checksum) {
+		t.Fatalf("pack checksum trailer = %x; want %x", buf[pos:pos+20], pw.checksum)
+	}
+	pos += 20
+
+	wantSum := sha1.Sum(buf[:pos])
+	if !bytes.Equal(buf[pos:pos+20], wantSum[:]) {
+		t.Fatalf("index checksum = %x; want %x", buf[pos:pos+20], wantSum)
+	}
+}